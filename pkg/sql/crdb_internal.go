@@ -72,17 +72,26 @@ CREATE TABLE crdb_internal.node_build_info (
 		nodeID := parser.NewDInt(parser.DInt(int64(node.NodeID.Get())))
 
 		info := build.GetInfo()
-		for k, v := range map[string]string{
+		fields := map[string]string{
 			"Name":         "CockroachDB",
 			"ClusterID":    node.ClusterID().String(),
 			"Organization": node.Organization.Get(),
 			"Build":        info.Short(),
 			"Version":      info.Tag,
-		} {
+		}
+
+		// Sort the field names to ensure the output is deterministic.
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
 			if err := addRow(
 				nodeID,
 				parser.NewDString(k),
-				parser.NewDString(v),
+				parser.NewDString(fields[k]),
 			); err != nil {
 				return err
 			}
@@ -356,7 +365,10 @@ func (s stmtList) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 func (s stmtList) Less(i, j int) bool {
-	return s[i].stmt < s[j].stmt
+	if s[i].stmt != s[j].stmt {
+		return s[i].stmt < s[j].stmt
+	}
+	return s[i].flags() < s[j].flags()
 }
 
 var crdbInternalStmtStatsTable = virtualSchemaTable{
@@ -420,6 +432,7 @@ CREATE TABLE crdb_internal.node_statement_statistics (
 				stmtKeys = append(stmtKeys, k)
 			}
 			appStats.Unlock()
+			sort.Sort(stmtKeys)
 
 			// Now retrieve the per-stmt stats proper.
 			for _, stmtKey := range stmtKeys {
@@ -829,7 +829,8 @@ func (sources multiSourceInfo) findColumn(
 	}
 
 	if colIdx == invalidColIdx {
-		return invalidSrcIdx, invalidColIdx, fmt.Errorf("column name %q not found", c)
+		return invalidSrcIdx, invalidColIdx, pgerror.NewErrorf(
+			pgerror.CodeUndefinedColumnError, "column name %q not found", c)
 	}
 
 	return srcIdx, colIdx, nil
@@ -778,6 +778,12 @@ func (dsp *distSQLPlanner) addSorters(p *physicalPlan, n *sortNode) {
 
 	if matchLen < len(n.ordering) {
 		// Sorting is needed; we add a stage of sorting processors.
+		//
+		// There is one sorter for each result stream, so each node only sorts
+		// its own part of the data; the ordering is preserved when the streams
+		// are merged. In particular, when the input is a distributed aggregation
+		// (where each final aggregator owns a hash partition of the groups), no
+		// further sorting is done on the gateway.
 		ordering := dsp.convertOrdering(n.ordering, p.planToStreamColMap)
 		if len(ordering.Columns) != len(n.ordering) {
 			panic(fmt.Sprintf(
@@ -63,6 +63,12 @@ func doExpandPlan(
 
 	case *insertNode:
 		n.run.rows, err = doExpandPlan(ctx, p, noParams, n.run.rows)
+		if s, ok := n.run.rows.(*sortNode); ok && err == nil && !n.insertOrderMatters() {
+			// The order in which the rows are inserted cannot be observed, so
+			// there is no need to sort them. The sortNode is removed or reduced
+			// to stripping extra columns by simplifyOrderings.
+			s.needSort = false
+		}
 
 	case *deleteNode:
 		n.run.rows, err = doExpandPlan(ctx, p, noParams, n.run.rows)
@@ -465,3 +465,29 @@ func fillDefaults(
 func (n *insertNode) Values() parser.Datums {
 	return n.run.resultRow
 }
+
+// insertOrderMatters returns true if the order in which the source rows are
+// inserted can be observed, in which case an ORDER BY clause on the source
+// must be honored.
+func (n *insertNode) insertOrderMatters() bool {
+	// With ON CONFLICT, a later row may override or be skipped in favor of
+	// an earlier row with the same key. RETURNING produces rows in the order
+	// in which they are inserted.
+	if n.n.OnConflict != nil {
+		return true
+	}
+	if _, ok := n.n.Returning.(*parser.ReturningExprs); ok {
+		return true
+	}
+	// Non-constant default values, such as unique_rowid() for a SERIAL
+	// column, are computed per inserted row, so their values can depend on
+	// the order of the rows.
+	if n.defaultExprs != nil {
+		for i := len(planColumns(n.run.rows)); i < len(n.insertCols); i++ {
+			if _, ok := n.defaultExprs[i].(parser.Datum); !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -77,7 +77,7 @@ func applyLimit(plan planNode, numRows int64, soft bool) {
 	case *sortNode:
 		if n.needSort && numRows != math.MaxInt64 {
 			v := n.p.newContainerValuesNode(planColumns(n.plan), int(numRows))
-			v.ordering = n.ordering
+			n.initSortValues(v)
 			if soft {
 				n.sortStrategy = newIterativeSortStrategy(v)
 			} else {
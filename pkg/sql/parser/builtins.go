@@ -31,6 +31,7 @@ import (
 	"net"
 	"regexp"
 	"regexp/syntax"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -238,6 +239,7 @@ func init() {
 		funDefs[name] = newFunctionDefinition(name, def)
 		AllBuiltinNames = append(AllBuiltinNames, name)
 	}
+	sort.Strings(AllBuiltinNames)
 
 	// We alias the builtins to uppercase to hasten the lookup in the
 	// common case.
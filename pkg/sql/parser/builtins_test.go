@@ -14,7 +14,10 @@
 
 package parser
 
-import "testing"
+import (
+	"sort"
+	"testing"
+)
 
 func TestCategory(t *testing.T) {
 	if expected, actual := categoryString, Builtins["lower"][0].Category(); expected != actual {
@@ -30,3 +33,12 @@ func TestCategory(t *testing.T) {
 		t.Fatalf("bad category: expected %q got %q", expected, actual)
 	}
 }
+
+func TestAllBuiltinNamesSorted(t *testing.T) {
+	if !sort.StringsAreSorted(AllBuiltinNames) {
+		t.Fatal("expected AllBuiltinNames to be sorted")
+	}
+	if len(AllBuiltinNames) == 0 {
+		t.Fatal("expected AllBuiltinNames to be populated")
+	}
+}
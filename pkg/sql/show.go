@@ -800,12 +800,15 @@ func (p *planner) ShowConstraints(
 	}, nil
 }
 
+// ShowQueries returns the running queries, most recently started first.
+// Privileges: None.
 func (p *planner) ShowQueries(ctx context.Context, n *parser.ShowQueries) (planNode, error) {
-	query := `TABLE crdb_internal.node_queries`
+	const getQueriesQuery = `SELECT * FROM crdb_internal.%s ORDER BY start DESC`
+	table := `node_queries`
 	if n.Cluster {
-		query = `TABLE crdb_internal.cluster_queries`
+		table = `cluster_queries`
 	}
-	return p.delegateQuery(ctx, "SHOW QUERIES", query, nil, nil)
+	return p.delegateQuery(ctx, "SHOW QUERIES", fmt.Sprintf(getQueriesQuery, table), nil, nil)
 }
 
 // ShowJobs returns all the jobs.
@@ -20,6 +20,12 @@
 //
 // These statements show the ranges corresponding to the given table or index,
 // along with the list of replicas and the lease holder.
+//
+// The ranges are returned in key order, as they are read from the meta
+// ranges. This is the natural order for this data and is not the same as
+// ordering by "Start Key", which is a pretty-printed string; a different
+// ordering can be obtained with:
+//   SELECT * FROM [SHOW TESTING_RANGES FROM TABLE t] ORDER BY ...
 
 package sql
 
@@ -338,15 +338,14 @@ func TestShowQueries(t *testing.T) {
 								}
 								defer rows.Close()
 
-								count := 0
+								var queries []string
 								for rows.Next() {
-									count++
-
 									var nodeID int
 									var sql string
 									if err := rows.Scan(&nodeID, &sql); err != nil {
 										t.Fatal(err)
 									}
+									queries = append(queries, sql)
 									switch sql {
 									case showQuery, expectedSelectStmt:
 									default:
@@ -364,8 +363,13 @@ func TestShowQueries(t *testing.T) {
 									t.Fatal(err)
 								}
 
-								if expectedCount := 2; count != expectedCount {
-									t.Fatalf("unexpected number of running queries: %d, expected %d", count, expectedCount)
+								if expectedCount := 2; len(queries) != expectedCount {
+									t.Fatalf("unexpected number of running queries: %d, expected %d", len(queries), expectedCount)
+								}
+								// The queries are ordered by descending start time, so the SHOW
+								// QUERIES statement, which started last, comes first.
+								if queries[0] != showQuery {
+									t.Fatalf("expected %+q to be listed first, got %+q", showQuery, queries)
 								}
 							}
 						},
@@ -18,11 +18,14 @@ package sql
 
 import (
 	"container/heap"
+	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
@@ -39,11 +42,20 @@ type sortNode struct {
 	needSort     bool
 	sortStrategy sortingStrategy
 	valueIter    valueIterator
+
+	// profile is a testing knob which, when set before the sort starts,
+	// makes the sortNode count the comparisons performed while sorting.
+	// The count is available through ComparisonCount.
+	profile     bool
+	comparisons int64
 }
 
-func ensureColumnOrderable(c sqlbase.ResultColumn) error {
+// ensureColumnOrderable returns an error if the values of the given column
+// cannot be ordered. The error mentions expr, which should be the expression
+// used to refer to the column, as written by the user.
+func ensureColumnOrderable(c sqlbase.ResultColumn, expr parser.Expr) error {
 	if _, ok := c.Typ.(parser.TArray); ok {
-		return errors.Errorf("can't order by column type %s", c.Typ)
+		return errors.Errorf("can't order by column type %s: %s", c.Typ, expr)
 	}
 	return nil
 }
@@ -87,6 +99,12 @@ func (p *planner) orderBy(
 		return nil, err
 	}
 
+	// Check that simple column references are valid before the loop below
+	// starts adding renders to the source.
+	if err := checkOrderByColumnsExist(orderBy, columns, s); err != nil {
+		return nil, err
+	}
+
 	for _, o := range orderBy {
 		direction := encoding.Ascending
 		if o.Direction == parser.Descending {
@@ -184,13 +202,15 @@ func (p *planner) orderBy(
 		// If we're ordering by using one of the existing renders, ensure it's a
 		// column type we can order on.
 		if index != -1 {
-			if err := ensureColumnOrderable(columns[index]); err != nil {
+			if err := ensureColumnOrderable(columns[index], expr); err != nil {
 				return nil, err
 			}
 		}
 
 		// Finally, if we haven't found anything so far, we really
-		// need a new render.
+		// need a new render. The expression is normalized when it is
+		// analyzed (constants are folded, double negations removed, etc.),
+		// so an expression equivalent to an existing render reuses it.
 		// TODO(knz/dan): currently this is only possible for renderNode.
 		// If we are dealing with a UNION or something else we would need
 		// to fabricate an intermediate renderNode to add the new render.
@@ -219,14 +239,14 @@ func (p *planner) orderBy(
 			// Ensure our newly rendered columns are ok to order by.
 			renderCols := planColumns(s)
 			for _, colIdx := range colIdxs {
-				if err := ensureColumnOrderable(renderCols[colIdx]); err != nil {
+				if err := ensureColumnOrderable(renderCols[colIdx], expr); err != nil {
 					return nil, err
 				}
 			}
 		}
 
 		if index == -1 {
-			return nil, errors.Errorf("column %s does not exist", expr)
+			return nil, errors.Errorf("column \"%s\" does not exist", expr)
 		}
 		ordering = append(ordering,
 			sqlbase.ColumnOrderInfo{ColIdx: index, Direction: direction})
@@ -239,6 +259,62 @@ func (p *planner) orderBy(
 	return &sortNode{p: p, columns: columns, ordering: ordering}, nil
 }
 
+// checkOrderByColumnsExist verifies that every ORDER BY expression that is
+// a column name refers either to one of the given output columns or, if
+// the source is a renderNode, to one of the columns of its data sources.
+// This way a missing column is reported with the same error regardless of
+// the kind of source and of the resolution rule that would otherwise have
+// failed. Other expressions are checked when they are resolved.
+func checkOrderByColumnsExist(
+	orderBy parser.OrderBy, columns sqlbase.ResultColumns, s *renderNode,
+) error {
+	for _, o := range orderBy {
+		vBase, ok := parser.StripParens(o.Expr).(parser.VarName)
+		if !ok {
+			continue
+		}
+		v, err := vBase.NormalizeVarName()
+		if err != nil {
+			return err
+		}
+		c, ok := v.(*parser.ColumnItem)
+		if !ok || len(c.Selector) > 0 {
+			continue
+		}
+		qualified := c.TableName.Table() != ""
+		if !qualified && findColumnByName(columns, c.ColumnName.Normalize()) {
+			continue
+		}
+		if s == nil {
+			if qualified {
+				continue
+			}
+			return errors.Errorf("column \"%s\" does not exist", c.ColumnName.Normalize())
+		}
+		if _, _, err := s.sourceInfo.findColumn(c); err != nil {
+			if pgErr, ok := pgerror.GetPGCause(err); ok && pgErr.Code == pgerror.CodeUndefinedColumnError {
+				if qualified {
+					return errors.Errorf("column \"%s\" does not exist", c)
+				}
+				return errors.Errorf("column \"%s\" does not exist", c.ColumnName.Normalize())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// findColumnByName returns true if one of the given columns has the given
+// normalized name.
+func findColumnByName(columns sqlbase.ResultColumns, name string) bool {
+	for _, col := range columns {
+		if parser.ReNormalizeName(col.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
 // rewriteIndexOrderings rewrites an ORDER BY clause that uses the
 // extended INDEX or PRIMARY KEY syntax into an ORDER BY clause that
 // doesn't: each INDEX or PRIMARY KEY order specification is replaced
@@ -358,6 +434,9 @@ func (p *planner) colIndex(numOriginalCols int, expr parser.Expr, context string
 		return -1, errors.Errorf("non-integer constant in %s: %s", context, expr)
 	}
 	if ord != -1 {
+		// Since numOriginalCols is an int, this check also guarantees that the
+		// conversion of ord to int below cannot overflow, even on platforms
+		// where int is 32 bits wide (e.g. ORDER BY 2147483648).
 		if ord < 1 || ord > int64(numOriginalCols) {
 			return -1, errors.Errorf("%s position %s is not in select list", context, expr)
 		}
@@ -366,6 +445,34 @@ func (p *planner) colIndex(numOriginalCols int, expr parser.Expr, context string
 	return int(ord), nil
 }
 
+// SetOrdering replaces the ordering requested from the sortNode, e.g. when
+// an optimization of a parent node needs its rows in a different order.
+// Every column in the new ordering must refer to a column produced by the
+// sortNode's source. Any sorting strategy chosen for the previous ordering
+// (see applyLimit) is discarded, and whether a sort is needed at all is
+// recomputed against the ordering of the source.
+func (n *sortNode) SetOrdering(ctx context.Context, ordering sqlbase.ColumnOrdering) error {
+	sourceCols := planColumns(n.plan)
+	for _, o := range ordering {
+		if o.ColIdx < 0 || o.ColIdx >= len(sourceCols) {
+			return errors.Errorf("invalid ordering column index %d (%d columns available)",
+				o.ColIdx, len(sourceCols))
+		}
+		col := sourceCols[o.ColIdx]
+		if err := ensureColumnOrderable(col, parser.UnresolvedName{parser.Name(col.Name)}); err != nil {
+			return err
+		}
+	}
+
+	if n.sortStrategy != nil {
+		n.sortStrategy.Close(ctx)
+		n.sortStrategy = nil
+	}
+	n.ordering = ordering
+	n.needSort = planOrdering(n.plan).computeMatch(ordering) < len(ordering)
+	return nil
+}
+
 func (n *sortNode) Values() parser.Datums {
 	// If an ordering expression was used the number of columns in each row might
 	// differ from the number of columns requested, so trim the result.
@@ -380,15 +487,21 @@ func (n *sortNode) Next(ctx context.Context) (bool, error) {
 	for n.needSort {
 		if v, ok := n.plan.(*valuesNode); ok {
 			// The plan we wrap is already a values node. Just sort it.
-			v.ordering = n.ordering
+			n.initSortValues(v)
 			n.sortStrategy = newSortAllStrategy(v)
 			n.sortStrategy.Finish(ctx)
 			n.needSort = false
 			break
 		} else if n.sortStrategy == nil {
 			v := n.p.newContainerValuesNode(planColumns(n.plan), 0)
-			v.ordering = n.ordering
-			n.sortStrategy = newSortAllStrategy(v)
+			n.initSortValues(v)
+			if planOrdering(n.plan).computeMatch(n.ordering) > 0 {
+				// The source is already sorted on a prefix of the ordering, so it
+				// is likely to produce long runs of values that are in order.
+				n.sortStrategy = newSortRunsStrategy(v)
+			} else {
+				n.sortStrategy = newSortAllStrategy(v)
+			}
 		}
 
 		// TODO(andrei): If we're scanning an index with a prefix matching an
@@ -419,12 +532,35 @@ func (n *sortNode) Next(ctx context.Context) (bool, error) {
 	return n.valueIter.Next(ctx)
 }
 
+// initSortValues prepares a valuesNode used by one of the sorting
+// strategies to sort values according to the sortNode's ordering.
+func (n *sortNode) initSortValues(v *valuesNode) {
+	v.ordering = n.ordering
+	if n.profile {
+		v.comparisons = &n.comparisons
+	}
+}
+
+// ComparisonCount returns the number of comparisons performed so far while
+// sorting. It is only maintained when profiling is enabled.
+func (n *sortNode) ComparisonCount() int64 {
+	return n.comparisons
+}
+
 func (n *sortNode) Close(ctx context.Context) {
+	// Note that when the source is a valuesNode, it is sorted in place: the
+	// sortStrategy wraps n.plan and closes it again, which is fine because
+	// valuesNode.Close is idempotent.
 	n.plan.Close(ctx)
 	if n.sortStrategy != nil {
 		n.sortStrategy.Close(ctx)
 	}
-	if n.valueIter != nil {
+	// The valueIter is usually either the source itself (when no sort was
+	// needed or the source was sorted in place) or the sortStrategy, both of
+	// which were closed above. Other plans may not support being closed
+	// twice, so only close it if it is a distinct object.
+	if n.valueIter != nil && n.valueIter != valueIterator(n.plan) &&
+		n.valueIter != valueIterator(n.sortStrategy) {
 		n.valueIter.Close(ctx)
 	}
 }
@@ -487,6 +623,174 @@ func (ss *sortAllStrategy) Close(ctx context.Context) {
 	ss.vNode.Close(ctx)
 }
 
+// sortRunsStrategy reads in all values into the wrapped valuesNode and,
+// similarly to Timsort, keeps track of the natural runs in the input: the
+// maximal sequences of consecutive values which are already in order. Once
+// all values have been added, the runs are merged with each other instead
+// of sorting all values from scratch. Detecting the runs costs n-1
+// comparisons; merging k runs has a worst-case time complexity of
+// O(n*log(k)), and no comparisons at all are needed if the input is
+// already sorted. The worst-case space complexity is O(n). If the runs are
+// too short to be worth merging, or if the memory needed to merge them
+// cannot be reserved, the values are sorted like sortAllStrategy does.
+//
+// The strategy is intended to be used when all values need to be sorted
+// and the input is likely to be partially sorted already.
+type sortRunsStrategy struct {
+	vNode *valuesNode
+	// runStarts contains the index of the first row of each run.
+	runStarts []int
+	// sortAll is set once the strategy has given up on merging the runs.
+	sortAll bool
+	// acc accounts for the memory used by runStarts and by the scratch
+	// space needed to merge the runs.
+	acc mon.BoundAccount
+}
+
+// sortRunsMinAvgLength is the average run length below which
+// sortRunsStrategy sorts all values instead of merging the runs.
+const sortRunsMinAvgLength = 8
+
+const sizeOfInt = int64(unsafe.Sizeof(int(0)))
+
+func newSortRunsStrategy(vNode *valuesNode) sortingStrategy {
+	return &sortRunsStrategy{
+		vNode: vNode,
+		acc:   vNode.p.session.TxnState.makeBoundAccount(),
+	}
+}
+
+func (ss *sortRunsStrategy) Add(ctx context.Context, values parser.Datums) error {
+	rows := ss.vNode.rows
+	if n := rows.Len(); !ss.sortAll && (n == 0 || ss.vNode.ValuesLess(values, rows.At(n-1))) {
+		// Give up early if the runs seen so far are so short that they are
+		// unlikely to be worth merging; this also bounds the size of
+		// runStarts.
+		if len(ss.runStarts)*sortRunsMinAvgLength > 2*n+sortRunsMinAvgLength {
+			ss.giveUp(ctx)
+		} else {
+			oldCap := cap(ss.runStarts)
+			ss.runStarts = append(ss.runStarts, n)
+			if newCap := cap(ss.runStarts); newCap != oldCap {
+				if err := ss.acc.Grow(ctx, int64(newCap-oldCap)*sizeOfInt); err != nil {
+					ss.giveUp(ctx)
+				}
+			}
+		}
+	}
+	_, err := rows.AddRow(ctx, values)
+	return err
+}
+
+// giveUp releases the memory used to track the runs; the values will be
+// sorted from scratch once they have all been added.
+func (ss *sortRunsStrategy) giveUp(ctx context.Context) {
+	ss.sortAll = true
+	ss.runStarts = nil
+	ss.acc.Clear(ctx)
+}
+
+func (ss *sortRunsStrategy) Finish(ctx context.Context) {
+	n := ss.vNode.Len()
+	switch {
+	case ss.sortAll:
+		ss.vNode.SortAll()
+	case len(ss.runStarts) <= 1:
+		// The values are already sorted.
+	case len(ss.runStarts)*sortRunsMinAvgLength > n:
+		ss.vNode.SortAll()
+	case ss.acc.Grow(ctx, 2*int64(n)*sizeOfInt) != nil:
+		// Not enough memory for the permutation and the scratch space.
+		ss.vNode.SortAll()
+	default:
+		ss.mergeRuns()
+	}
+	ss.runStarts = nil
+	ss.acc.Clear(ctx)
+}
+
+// mergeRuns sorts the values by merging the runs pairwise until a single
+// run is left. The merges are performed on a permutation of the row
+// indexes, which is only applied to the rows at the end; this avoids
+// copying the rows themselves into temporary buffers.
+func (ss *sortRunsStrategy) mergeRuns() {
+	v := ss.vNode
+	n := v.rows.Len()
+	less := func(i, j int) bool {
+		return v.ValuesLess(v.rows.At(i), v.rows.At(j))
+	}
+
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	buf := make([]int, n)
+
+	// The bounds of the merged runs are written over the bounds of the runs
+	// being merged, which are always read first.
+	bounds := append(ss.runStarts, n)
+	for len(bounds) > 2 {
+		merged := bounds[:0]
+		for i := 0; i+1 < len(bounds); i += 2 {
+			lo := bounds[i]
+			if i+2 < len(bounds) {
+				mergeSortedRuns(perm, buf, lo, bounds[i+1], bounds[i+2], less)
+			}
+			merged = append(merged, lo)
+		}
+		bounds = append(merged, n)
+	}
+
+	// Apply the permutation to the rows, following each of its cycles: the
+	// row at position i must be replaced by the row at position perm[i].
+	for i := range perm {
+		j := i
+		for perm[j] != i {
+			next := perm[j]
+			v.rows.Swap(j, next)
+			perm[j] = j
+			j = next
+		}
+		perm[j] = j
+	}
+}
+
+// mergeSortedRuns merges the sorted runs perm[lo:mid] and perm[mid:hi],
+// using buf as scratch space. The merge is stable.
+func mergeSortedRuns(perm, buf []int, lo, mid, hi int, less func(i, j int) bool) {
+	if !less(perm[mid], perm[mid-1]) {
+		// The runs are already in order with respect to each other.
+		return
+	}
+	i, j, k := lo, mid, lo
+	for i < mid && j < hi {
+		if less(perm[j], perm[i]) {
+			buf[k] = perm[j]
+			j++
+		} else {
+			buf[k] = perm[i]
+			i++
+		}
+		k++
+	}
+	k += copy(buf[k:], perm[i:mid])
+	copy(buf[k:], perm[j:hi])
+	copy(perm[lo:hi], buf[lo:hi])
+}
+
+func (ss *sortRunsStrategy) Next(ctx context.Context) (bool, error) {
+	return ss.vNode.Next(ctx)
+}
+
+func (ss *sortRunsStrategy) Values() parser.Datums {
+	return ss.vNode.Values()
+}
+
+func (ss *sortRunsStrategy) Close(ctx context.Context) {
+	ss.acc.Close(ctx)
+	ss.vNode.Close(ctx)
+}
+
 // iterativeSortStrategy reads in all values into the wrapped valuesNode
 // and turns the underlying slice into a min-heap. It then pops a value
 // off of the heap for each call to Next, meaning that it only needs to
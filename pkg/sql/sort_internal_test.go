@@ -0,0 +1,539 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Note that there's also a sort_test.go, in package sql_test.
+
+package sql
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+// makeTestSortNode returns a sortNode (with no ordering) on top of a
+// valuesNode containing the given rows of integers.
+func makeTestSortNode(t *testing.T, p *planner, rows [][]int) *sortNode {
+	var columns sqlbase.ResultColumns
+	if len(rows) > 0 {
+		for i := range rows[0] {
+			columns = append(columns, sqlbase.ResultColumn{
+				Name: string(rune('a' + i)), Typ: parser.TypeInt,
+			})
+		}
+	}
+	v := p.newContainerValuesNode(columns, len(rows))
+	for _, r := range rows {
+		row := make(parser.Datums, len(r))
+		for i, d := range r {
+			row[i] = parser.NewDInt(parser.DInt(d))
+		}
+		if _, err := v.rows.AddRow(context.TODO(), row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &sortNode{p: p, plan: v, columns: columns}
+}
+
+// collectSortedInts runs the given sortNode to completion and returns the
+// values of its first column.
+func collectSortedInts(t *testing.T, n *sortNode) []int {
+	ctx := context.TODO()
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var res []int
+	for {
+		next, err := n.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !next {
+			break
+		}
+		res = append(res, int(parser.MustBeDInt(n.Values()[0])))
+	}
+	return res
+}
+
+func TestSortNodeSetOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	ctx := context.TODO()
+
+	n := makeTestSortNode(t, p, [][]int{{1, 3}, {2, 1}, {3, 2}})
+	defer n.Close(ctx)
+
+	o := func(colIdx int, direction encoding.Direction) sqlbase.ColumnOrderInfo {
+		return sqlbase.ColumnOrderInfo{ColIdx: colIdx, Direction: direction}
+	}
+
+	err := n.SetOrdering(ctx, sqlbase.ColumnOrdering{o(2, encoding.Ascending)})
+	if !testutils.IsError(err, "invalid ordering column index 2") {
+		t.Fatalf("expected invalid column index error, got %v", err)
+	}
+
+	// Simulate a limit having selected a strategy for a previous ordering.
+	v := p.newContainerValuesNode(n.columns, 1)
+	n.sortStrategy = newSortTopKStrategy(v, 1)
+
+	if err := n.SetOrdering(ctx, sqlbase.ColumnOrdering{o(1, encoding.Descending)}); err != nil {
+		t.Fatal(err)
+	}
+	if n.sortStrategy != nil {
+		t.Fatal("expected the previous sort strategy to be discarded")
+	}
+	if !n.needSort {
+		t.Fatal("expected the sortNode to need a sort on an unordered source")
+	}
+
+	if res, expected := collectSortedInts(t, n), []int{1, 3, 2}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestColIndexBounds(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+
+	testCases := []struct {
+		expr        parser.Expr
+		numCols     int
+		expectedIdx int
+		expectedErr string
+	}{
+		{parser.NewDInt(1), 3, 0, ""},
+		{parser.NewDInt(3), 3, 2, ""},
+		{parser.NewDInt(0), 3, -1, "ORDER BY position 0 is not in select list"},
+		{parser.NewDInt(4), 3, -1, "ORDER BY position 4 is not in select list"},
+		{parser.NewDInt(math.MaxInt32), 3, -1, "ORDER BY position 2147483647 is not in select list"},
+		{parser.NewDInt(math.MaxInt32 + 1), 3, -1, "ORDER BY position 2147483648 is not in select list"},
+		{parser.NewDInt(math.MaxInt64), 3, -1, "ORDER BY position 9223372036854775807 is not in select list"},
+		// Negative DInts are not ordinals.
+		{parser.NewDInt(-1), 3, -1, ""},
+	}
+
+	for _, tc := range testCases {
+		idx, err := p.colIndex(tc.numCols, tc.expr, "ORDER BY")
+		if !testutils.IsError(err, tc.expectedErr) {
+			t.Errorf("%s: expected error %q, got %v", tc.expr, tc.expectedErr, err)
+			continue
+		}
+		if idx != tc.expectedIdx {
+			t.Errorf("%s: expected index %d, got %d", tc.expr, tc.expectedIdx, idx)
+		}
+	}
+}
+
+// makeRunsInput returns numRows rows consisting of runs of the given
+// length in the given direction, each starting at a random value.
+func makeRunsInput(
+	rng *rand.Rand, numRows, runLength int, dir encoding.Direction,
+) []parser.Datums {
+	rows := make([]parser.Datums, numRows)
+	for i := 0; i < numRows; i += runLength {
+		start := rng.Intn(numRows)
+		for j := i; j < i+runLength && j < numRows; j++ {
+			val := start + j - i
+			if dir == encoding.Descending {
+				val = start - (j - i)
+			}
+			rows[j] = parser.Datums{parser.NewDInt(parser.DInt(val))}
+		}
+	}
+	return rows
+}
+
+func TestSortRunsStrategy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	ctx := context.TODO()
+	rng, _ := randutil.NewPseudoRand()
+
+	columns := sqlbase.ResultColumns{{Name: "a", Typ: parser.TypeInt}}
+	for _, dir := range []encoding.Direction{encoding.Ascending, encoding.Descending} {
+		ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: dir}}
+		for _, numRows := range []int{0, 1, 10, 100, 1000} {
+			// Run lengths of 1 and 3 exercise the fallback to sorting all
+			// values; the other lengths exercise merging.
+			for _, runLength := range []int{1, 3, 16, 100, 1000} {
+				input := makeRunsInput(rng, numRows, runLength, dir)
+				expected := make([]int, numRows)
+				for i, row := range input {
+					expected[i] = int(parser.MustBeDInt(row[0]))
+				}
+				sort.Ints(expected)
+				if dir == encoding.Descending {
+					sort.Sort(sort.Reverse(sort.IntSlice(expected)))
+				}
+
+				v := p.newContainerValuesNode(columns, 0)
+				v.ordering = ordering
+				ss := newSortRunsStrategy(v)
+				for _, row := range input {
+					if err := ss.Add(ctx, row); err != nil {
+						t.Fatal(err)
+					}
+				}
+				ss.Finish(ctx)
+				var res []int
+				for {
+					next, err := ss.Next(ctx)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !next {
+						break
+					}
+					res = append(res, int(parser.MustBeDInt(ss.Values()[0])))
+				}
+				ss.Close(ctx)
+
+				if len(res) != len(expected) || (len(res) > 0 && !reflect.DeepEqual(res, expected)) {
+					t.Errorf("direction %d, %d rows, run length %d: expected %v, got %v",
+						dir, numRows, runLength, expected, res)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkSortStrategies compares the strategies used to sort all values
+// on inputs which are sorted to varying degrees.
+func BenchmarkSortStrategies(b *testing.B) {
+	p := makeTestPlanner()
+	ctx := context.TODO()
+	rng, _ := randutil.NewPseudoRand()
+
+	const numRows = 10000
+	columns := sqlbase.ResultColumns{{Name: "a", Typ: parser.TypeInt}}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+
+	strategies := []struct {
+		name        string
+		newStrategy func(*valuesNode) sortingStrategy
+	}{
+		{"SortAll", newSortAllStrategy},
+		{"SortRuns", newSortRunsStrategy},
+	}
+	for _, runLength := range []int{1, 16, 256, numRows} {
+		input := makeRunsInput(rng, numRows, runLength, encoding.Ascending)
+		for _, s := range strategies {
+			b.Run(fmt.Sprintf("%s/runLength=%d", s.name, runLength), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					v := p.newContainerValuesNode(columns, numRows)
+					v.ordering = ordering
+					ss := s.newStrategy(v)
+					for _, row := range input {
+						if err := ss.Add(ctx, row); err != nil {
+							b.Fatal(err)
+						}
+					}
+					ss.Finish(ctx)
+					ss.Close(ctx)
+				}
+			})
+		}
+	}
+}
+
+// TestSortNodeCloseValuesSource verifies that closing a sortNode which
+// sorted its valuesNode source in place, and which therefore closes that
+// valuesNode multiple times, releases its memory exactly once.
+func TestSortNodeCloseValuesSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	ctx := context.TODO()
+	txnMon := &p.session.TxnState.mon
+
+	n := makeTestSortNode(t, p, [][]int{{3}, {1}, {2}})
+	v := n.plan.(*valuesNode)
+	if err := n.SetOrdering(ctx, sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, expected := collectSortedInts(t, n), []int{1, 2, 3}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if ss, ok := n.sortStrategy.(*sortAllStrategy); !ok || ss.vNode != v {
+		t.Fatalf("expected the valuesNode to be sorted in place, got strategy %T", n.sortStrategy)
+	}
+	if n.valueIter != valueIterator(v) {
+		t.Fatalf("expected the valuesNode to be the value iterator, got %T", n.valueIter)
+	}
+	if txnMon.GetCurrentAllocationForTesting() == 0 {
+		t.Fatal("expected the valuesNode to have allocated memory")
+	}
+
+	n.Close(ctx)
+	if v.rows != nil {
+		t.Fatal("expected the valuesNode to be closed")
+	}
+	if a := txnMon.GetCurrentAllocationForTesting(); a != 0 {
+		t.Fatalf("expected all memory to be released, %d bytes still allocated", a)
+	}
+
+	// Closing the sortNode again is harmless as well.
+	n.Close(ctx)
+}
+
+// closeCountingNode is a valuesNode which counts how many times it is
+// closed.
+type closeCountingNode struct {
+	*valuesNode
+	closed int
+}
+
+func (n *closeCountingNode) Close(ctx context.Context) {
+	n.closed++
+	n.valuesNode.Close(ctx)
+}
+
+// TestSortNodeClosePassThroughSource verifies that closing a sortNode which
+// did not need to sort, and which therefore passed its source's rows
+// through, closes that source exactly once.
+func TestSortNodeClosePassThroughSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	ctx := context.TODO()
+
+	n := makeTestSortNode(t, p, [][]int{{1}, {3}, {2}})
+	src := &closeCountingNode{valuesNode: n.plan.(*valuesNode)}
+	n.plan = src
+
+	if res, expected := collectSortedInts(t, n), []int{1, 3, 2}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if n.valueIter != valueIterator(src) {
+		t.Fatalf("expected the source to be the value iterator, got %T", n.valueIter)
+	}
+
+	n.Close(ctx)
+	if src.closed != 1 {
+		t.Fatalf("expected the source to be closed once, got %d", src.closed)
+	}
+}
+
+// TestColIndexRandom checks that colIndex, given arbitrary numeric
+// expressions such as can be found in ORDER BY clauses, always returns
+// either a valid column index, -1 if the expression is not an ordinal, or
+// an error; it must never panic or return an out of bounds index.
+func TestColIndexRandom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	rng, _ := randutil.NewPseudoRand()
+
+	randIntLiteral := func() string {
+		switch rng.Intn(4) {
+		case 0:
+			return strconv.Itoa(rng.Intn(12))
+		case 1:
+			return strconv.FormatInt(rng.Int63(), 10)
+		case 2:
+			// Out of the int64 range.
+			return strconv.FormatUint(math.MaxUint64-uint64(rng.Int63()), 10)
+		default:
+			return fmt.Sprintf("%d%018d", rng.Intn(1000)+1, rng.Int63n(1e18))
+		}
+	}
+	randExpr := func() string {
+		switch rng.Intn(6) {
+		case 0:
+			return "-" + randIntLiteral()
+		case 1:
+			return randIntLiteral() + "." + strconv.Itoa(rng.Intn(100))
+		case 2:
+			return randIntLiteral() + "e" + strconv.Itoa(rng.Intn(40)-20)
+		case 3:
+			return "(" + randIntLiteral() + ")"
+		case 4:
+			return "'" + randIntLiteral() + "'"
+		default:
+			return randIntLiteral()
+		}
+	}
+
+	check := func(numCols int, expr parser.Expr) {
+		idx, err := func() (_ int, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = errors.Errorf("panic: %v", r)
+					t.Errorf("%s (%T), %d columns: %v", expr, expr, numCols, err)
+				}
+			}()
+			return p.colIndex(numCols, expr, "ORDER BY")
+		}()
+		if err != nil {
+			if idx != -1 {
+				t.Errorf("%s (%T), %d columns: expected index -1 with error %v, got %d",
+					expr, expr, numCols, err, idx)
+			}
+			return
+		}
+		if idx < -1 || idx >= numCols {
+			t.Errorf("%s (%T), %d columns: index %d out of bounds", expr, expr, numCols, idx)
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		numCols := rng.Intn(10)
+
+		sql := randExpr()
+		expr, err := parser.ParseExpr(sql)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		check(numCols, parser.StripParens(expr))
+
+		d := parser.DInt(rng.Int63())
+		if rng.Intn(2) == 0 {
+			d = parser.DInt(rng.Intn(12) - 1)
+		} else if rng.Intn(2) == 0 {
+			d = -d
+		}
+		check(numCols, parser.NewDInt(d))
+	}
+}
+
+// TestSortNodeComparisonCount verifies that a profiled sortNode counts the
+// comparisons it performs, and that sorting all values of a random input
+// stays within a small factor of n*log2(n) comparisons.
+func TestSortNodeComparisonCount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := makeTestPlanner()
+	ctx := context.TODO()
+	rng, _ := randutil.NewPseudoRand()
+
+	const numRows = 1000
+	rows := make([][]int, numRows)
+	for i := range rows {
+		rows[i] = []int{rng.Int()}
+	}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+
+	for _, profile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("profile=%t", profile), func(t *testing.T) {
+			n := makeTestSortNode(t, p, rows)
+			defer n.Close(ctx)
+			n.profile = profile
+			if err := n.SetOrdering(ctx, ordering); err != nil {
+				t.Fatal(err)
+			}
+
+			if res := collectSortedInts(t, n); !sort.IntsAreSorted(res) {
+				t.Fatalf("expected sorted results, got %v", res)
+			}
+
+			count := n.ComparisonCount()
+			if !profile {
+				if count != 0 {
+					t.Fatalf("expected no comparisons to be counted, got %d", count)
+				}
+				return
+			}
+			if limit := int64(numRows * math.Log2(numRows) * 1.5); count == 0 || count > limit {
+				t.Fatalf("expected between 1 and %d comparisons, got %d", limit, count)
+			}
+		})
+	}
+}
+
+// BenchmarkSortPlanning measures the cost of planning ORDER BY clauses of
+// varying complexity with orderBy, excluding the planning of the rest of
+// the query and its execution.
+func BenchmarkSortPlanning(b *testing.B) {
+	s, db, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	if _, err := db.Exec(`
+CREATE DATABASE test;
+CREATE TABLE test.t (a INT PRIMARY KEY, b INT, c INT, d INT, e INT, INDEX bcd (b, c, d))
+`); err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	txn := client.NewTxn(kvDB)
+	txn.Proto().OrigTimestamp = s.Clock().Now()
+	p := makeInternalPlanner("plan", txn, security.RootUser, &MemoryMetrics{})
+	defer finishInternalPlanner(p)
+	p.session.tables.leaseMgr = s.LeaseManager().(*LeaseManager)
+	p.session.Database = "test"
+
+	testCases := []struct {
+		name    string
+		orderBy string
+	}{
+		{"1Column", "a"},
+		{"5Columns", "a, b DESC, c, d DESC, e"},
+		{"Index", "INDEX t@bcd"},
+		{"Expression", "a + b * c, e"},
+	}
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			stmt, err := parser.ParseOne("SELECT a, b, c, d, e FROM t ORDER BY " + tc.orderBy)
+			if err != nil {
+				b.Fatal(err)
+			}
+			sel := stmt.(*parser.Select)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// orderBy may add renders to its source, so plan a fresh one for
+				// every iteration.
+				b.StopTimer()
+				plan, err := p.newPlan(ctx, sel.Select, nil /* desiredTypes */)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if _, err := p.orderBy(ctx, sel.OrderBy, plan); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				plan.Close(ctx)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -17,12 +17,17 @@
 package sql_test
 
 import (
+	"math/rand"
+	"reflect"
+	"sort"
 	"testing"
 
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 )
 
 func TestOrderByRandom(t *testing.T) {
@@ -51,3 +56,75 @@ func TestOrderByRandom(t *testing.T) {
 		}
 	}
 }
+
+func randLetters(rng *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + rng.Intn(26))
+	}
+	return string(b)
+}
+
+// TestOrderByLongStringKey checks that sorting on strings much larger than
+// a page, which only differ after long common prefixes, produces the same
+// order as a reference sort.
+func TestOrderByLongStringKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	params, _ := createTestServerParams()
+	s, db, _ := serverutils.StartServer(t, params)
+	defer s.Stopper().Stop(context.TODO())
+	sqlDB := sqlutils.MakeSQLRunner(t, db)
+
+	sqlDB.Exec(`CREATE DATABASE test; CREATE TABLE test.t (k INT PRIMARY KEY, s STRING)`)
+
+	rng, _ := randutil.NewPseudoRand()
+	const numRows = 100
+	const keyLen = 64 << 10
+	base := randLetters(rng, keyLen)
+	values := make([]string, numRows)
+	for i := range values {
+		prefixLen := rng.Intn(keyLen)
+		values[i] = base[:prefixLen] + randLetters(rng, keyLen-prefixLen)
+		sqlDB.Exec(`INSERT INTO test.t VALUES ($1, $2)`, i, values[i])
+	}
+
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	reversed := make([]string, numRows)
+	for i, v := range sorted {
+		reversed[numRows-1-i] = v
+	}
+
+	testCases := []struct {
+		query    string
+		expected []string
+	}{
+		{`SELECT s FROM test.t ORDER BY s`, sorted},
+		{`SELECT s FROM test.t ORDER BY s DESC`, reversed},
+		{`SELECT s FROM test.t ORDER BY s LIMIT 10`, sorted[:10]},
+	}
+	for _, tc := range testCases {
+		rows := sqlDB.Query(tc.query)
+		var res []string
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, v)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if !reflect.DeepEqual(res, tc.expected) {
+			for i := range res {
+				if i >= len(tc.expected) || res[i] != tc.expected[i] {
+					t.Fatalf("%s: unexpected value at position %d", tc.query, i)
+				}
+			}
+			t.Fatalf("%s: expected %d rows, got %d", tc.query, len(tc.expected), len(res))
+		}
+	}
+}
@@ -45,6 +45,10 @@ type valuesNode struct {
 
 	nextRow       int  // The index of the next row.
 	invertSorting bool // Inverts the sorting predicate.
+
+	// comparisons, if set, is incremented for every comparison of two rows.
+	// It is used by sortNode profiling.
+	comparisons *int64
 }
 
 func (p *planner) newContainerValuesNode(columns sqlbase.ResultColumns, capacity int) *valuesNode {
@@ -187,7 +191,15 @@ func (n *valuesNode) Less(i, j int) bool {
 
 // ValuesLess returns the comparison result between the two provided Datums slices
 // in the context of the valuesNode ordering.
+//
+// The comparison relies on Datum.Compare providing a total order. Notably,
+// DFloat.Compare treats NaN as equal to itself and smaller than every other
+// float (matching the key encoding used by indexes), so sort.Sort and the
+// heap used by sortTopKStrategy see a consistent ordering.
 func (n *valuesNode) ValuesLess(ra, rb parser.Datums) bool {
+	if n.comparisons != nil {
+		*n.comparisons++
+	}
 	return sqlbase.CompareDatums(n.ordering, &n.p.evalCtx, ra, rb) < 0
 }
 